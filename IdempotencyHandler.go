@@ -1,18 +1,60 @@
 package idempLib
 
 import (
-	"errors"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
-	"go.opentelemetry.io/otel/trace"
+	"io"
 	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/metric/global"
+	"go.opentelemetry.io/otel/metric/instrument"
+	"go.opentelemetry.io/otel/metric/instrument/syncfloat64"
+	"go.opentelemetry.io/otel/metric/instrument/syncint64"
+	"go.opentelemetry.io/otel/metric/unit"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 const (
-	IDEMP_HEDER = "Idempotency-Key"
+	// DefaultIdempotencyKeyHeader is the header carrying the idempotency key,
+	// unless a different one is set via WithHeaderName.
+	DefaultIdempotencyKeyHeader = "Idempotency-Key"
+
+	// IDEMP_HEDER is kept around for existing callers that reference it directly.
+	//
+	// Deprecated: use DefaultIdempotencyKeyHeader instead.
+	IDEMP_HEDER = DefaultIdempotencyKeyHeader
+
+	instrumentationName = "idempLib"
+
+	// DefaultTTL is the lifetime a cached response gets when no WithTTL
+	// option is supplied to NewIdempotencyHandler.
+	DefaultTTL = 3 * time.Minute
+
+	lockPollInterval = 50 * time.Millisecond
+	lockWaitTimeout  = 5 * time.Second
 )
 
-func tooManyArgumentsError(fnc string) error {
-	return errors.New(fmt.Sprintf("%s : you passed in to many argumants into this function", fnc))
+/*
+defaultIdempotentMethods returns the set of HTTP methods that can mutate
+state and therefore need idempotency-key handling, unless WithMethods
+overrides it.
+*/
+func defaultIdempotentMethods() map[string]bool {
+	return map[string]bool{
+		http.MethodPost:   true,
+		http.MethodPut:    true,
+		http.MethodPatch:  true,
+		http.MethodDelete: true,
+	}
 }
 
 type IdempotencyHandler interface {
@@ -20,60 +62,377 @@ type IdempotencyHandler interface {
 }
 
 type IdempotencyHandlerImpl struct {
-	repo   IdempontencyRepo
-	Tracer trace.Tracer
+	repo Driver
+	ttl  time.Duration
+
+	headerName   string
+	methods      map[string]bool
+	requireKey   bool
+	keyValidator KeyValidator
+
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+
+	hitCounter      syncint64.Counter
+	missCounter     syncint64.Counter
+	conflictCounter syncint64.Counter
+	lookupLatency   syncfloat64.Histogram
+}
+
+/*
+HandlerOption customizes an IdempotencyHandlerImpl built by NewIdempotencyHandler.
+*/
+type HandlerOption func(*IdempotencyHandlerImpl)
+
+/*
+WithTracer overrides the trace.Tracer used to create spans for the middleware.
+By default the handler pulls a tracer from otel.GetTracerProvider(), so this is
+only needed when the caller wants to pin a specific provider/instrumentation
+name instead.
+*/
+func WithTracer(tracer trace.Tracer) HandlerOption {
+	return func(h *IdempotencyHandlerImpl) {
+		h.tracer = tracer
+	}
 }
 
 /*
-NewIdempotencyHandler generates new instance of idempontency service and takes in tracer as optional parameter.
-Function also returns tooManyArgumentsErr if we pass in more than one tracer as a parameter.
+WithMeter overrides the metric.Meter used to record the idempotency.hits,
+idempotency.misses and idempotency.conflicts counters and the lookup latency
+histogram. By default the handler pulls a meter from global.Meter(), the
+otel/metric SDK's global MeterProvider.
 */
-func NewIdempotencyHandler(tracer ...trace.Tracer) (IdempotencyHandler, error) {
-	if len(tracer) > 1 {
-		return nil, tooManyArgumentsError("NewIdempotencyService")
+func WithMeter(meter metric.Meter) HandlerOption {
+	return func(h *IdempotencyHandlerImpl) {
+		registerInstruments(h, meter)
 	}
+}
 
-	if len(tracer) == 0 {
-		tracer = make([]trace.Tracer, 1)
+/*
+WithTTL overrides DefaultTTL, the lifetime cached responses are stored for.
+*/
+func WithTTL(ttl time.Duration) HandlerOption {
+	return func(h *IdempotencyHandlerImpl) {
+		h.ttl = ttl
 	}
+}
 
-	repo, err := NewIdempotenceRepo(tracer[0])
-	if err != nil {
-		return nil, err
+/*
+WithIncomingTraceContext makes the middleware extract the trace context carried
+on the incoming request's headers (via otel.GetTextMapPropagator(), the same
+mechanism otelhttp.NewHandler uses) before starting its own span, so the span
+joins the upstream trace instead of starting a new one.
+*/
+func WithIncomingTraceContext() HandlerOption {
+	return func(h *IdempotencyHandlerImpl) {
+		h.propagator = otel.GetTextMapPropagator()
 	}
+}
 
-	return &IdempotencyHandlerImpl{
-		repo:   repo,
-		Tracer: tracer[0],
-	}, nil
+/*
+WithHeaderName overrides DefaultIdempotencyKeyHeader, the header the
+middleware reads the idempotency key from.
+*/
+func WithHeaderName(name string) HandlerOption {
+	return func(h *IdempotencyHandlerImpl) {
+		h.headerName = name
+	}
 }
 
 /*
-MiddlewareIdempotency is middleware function which intercepts all incoming requests. Function check if request can collapse consistency of our system(PUT,POST,DELETE,PUT)
-and checks header for Idempotency-key variable to see if that request was handled before and stored in db. If not it will store it in redis with TLL = 3min
+WithMethods overrides the default idempotent method set (POST, PUT, PATCH,
+DELETE) with methods. Requests using any other method bypass the middleware
+entirely, the same as a non-idempotent request does today.
+*/
+func WithMethods(methods ...string) HandlerOption {
+	return func(h *IdempotencyHandlerImpl) {
+		set := make(map[string]bool, len(methods))
+		for _, method := range methods {
+			set[strings.ToUpper(method)] = true
+		}
+		h.methods = set
+	}
+}
+
+/*
+WithRequireKey makes a mutating request that omits the idempotency key header
+fail with 400 Bad Request instead of passing through to next unchecked, per
+draft-ietf-httpapi-idempotency-key-header.
+*/
+func WithRequireKey() HandlerOption {
+	return func(h *IdempotencyHandlerImpl) {
+		h.requireKey = true
+	}
+}
+
+/*
+WithKeyValidator overrides DefaultKeyValidator, the function used to reject a
+malformed idempotency key with 400 Bad Request before it is looked up or
+stored. UUIDKeyValidator and ULIDKeyValidator are provided for deployments
+that mint keys in one of those formats.
+*/
+func WithKeyValidator(validator KeyValidator) HandlerOption {
+	return func(h *IdempotencyHandlerImpl) {
+		h.keyValidator = validator
+	}
+}
+
+/*
+NewIdempotencyHandler generates new instance of idempontency service and takes in a storage Driver and
+any number of HandlerOptions. Passing a nil driver falls back to a redis Driver built from
+RedisConfigFromEnv, preserving the previous IDEMPOTENCE_REDIS_HOST/PORT based setup; pass NewMemoryDriver,
+NewEtcdDriver or a mock explicitly to use a different backend. Without WithTracer/WithMeter, the handler
+pulls its tracer from otel.GetTracerProvider() and its meter from the otel/metric SDK's global
+MeterProvider, so callers never have to nil-check them.
+*/
+func NewIdempotencyHandler(driver Driver, opts ...HandlerOption) (IdempotencyHandler, error) {
+	if driver == nil {
+		cfg, err := RedisConfigFromEnv()
+		if err != nil {
+			return nil, err
+		}
+
+		driver, err = NewIdempotenceRepo(cfg)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	handler := &IdempotencyHandlerImpl{
+		repo:         driver,
+		ttl:          DefaultTTL,
+		headerName:   DefaultIdempotencyKeyHeader,
+		methods:      defaultIdempotentMethods(),
+		keyValidator: DefaultKeyValidator,
+		tracer:       otel.Tracer(instrumentationName),
+	}
+	registerInstruments(handler, global.Meter(instrumentationName))
+
+	for _, opt := range opts {
+		opt(handler)
+	}
+
+	return handler, nil
+}
+
+/*
+registerInstruments (re)creates the counters/histogram used by handler off of
+meter. It is factored out so both the NewIdempotencyHandler default and
+WithMeter go through the same instrument definitions.
+*/
+func registerInstruments(handler *IdempotencyHandlerImpl, meter metric.Meter) {
+	handler.hitCounter, _ = meter.SyncInt64().Counter("idempotency.hits",
+		instrument.WithDescription("number of requests replayed from a cached response"))
+	handler.missCounter, _ = meter.SyncInt64().Counter("idempotency.misses",
+		instrument.WithDescription("number of requests with no cached response, so the handler ran"))
+	handler.conflictCounter, _ = meter.SyncInt64().Counter("idempotency.conflicts",
+		instrument.WithDescription("number of requests reusing a key with a different request body"))
+	handler.lookupLatency, _ = meter.SyncFloat64().Histogram("idempotency.lookup.latency",
+		instrument.WithDescription("time spent looking up a cached response"), instrument.WithUnit(unit.Milliseconds))
+}
+
+/*
+responseRecorder wraps a http.ResponseWriter so the first response written for
+a request can be buffered (status, headers, body) without reaching the real
+client until flush is called. Buffering instead of streaming through live
+means a later cache-write failure can be reported on the span without
+corrupting a response that was already sent.
+*/
+type responseRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func newResponseRecorder(rw http.ResponseWriter) *responseRecorder {
+	return &responseRecorder{ResponseWriter: rw, statusCode: http.StatusOK}
+}
+
+func (r *responseRecorder) WriteHeader(statusCode int) {
+	r.statusCode = statusCode
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	return r.body.Write(b)
+}
+
+/*
+flush writes the buffered status and body through to the real client. It must
+be called exactly once, after next has finished handling the request.
+*/
+func (r *responseRecorder) flush() {
+	r.ResponseWriter.WriteHeader(r.statusCode)
+	r.ResponseWriter.Write(r.body.Bytes())
+}
+
+/*
+MiddlewareIdempotency is middleware function which intercepts all incoming requests. Function checks if the request
+uses one of handler.methods (POST, PUT, PATCH, DELETE by default) and checks handler.headerName (Idempotency-Key by
+default) for a key to see if that request was handled before. If it was, and the replayed request's body matches the
+original, the cached response is replayed verbatim instead of re-running the handler; a body mismatch under the same
+key instead gets 409 Conflict, per draft-ietf-httpapi-idempotency-key-header. A short-lived per-key lock makes sure
+that a second concurrent request with the same key waits for the first one to finish instead of racing it; a request
+that is still waiting when the lock owner hasn't finished gets 425 Too Early instead of falling through to a second,
+racing execution of next. Successful responses are cached with a TTL of handler.ttl (DefaultTTL unless WithTTL was
+passed to NewIdempotencyHandler).
 */
 func (handler *IdempotencyHandlerImpl) MiddlewareIdempotency(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(rw http.ResponseWriter, h *http.Request) {
-		if h.Method == http.MethodPost || h.Method == http.MethodPut || h.Method == http.MethodPatch || h.Method == http.MethodDelete {
-			if handler.Tracer != nil {
-				ctx, span := handler.Tracer.Start(h.Context(), "IdempotencyHandler.MiddlewareIdempotency")
-				defer span.End()
-
-				if h.Header.Get(IDEMP_HEDER) != "" && handler.repo.Exists(h.Header.Get(IDEMP_HEDER), ctx) {
-					rw.WriteHeader(http.StatusOK)
-					return
-				} else {
-					handler.repo.Save(h.Header.Get(IDEMP_HEDER), ctx)
-				}
-			} else {
-				if h.Header.Get(IDEMP_HEDER) != "" && handler.repo.Exists(h.Header.Get(IDEMP_HEDER), nil) {
-					rw.WriteHeader(http.StatusOK)
-					return
-				} else {
-					handler.repo.Save(h.Header.Get(IDEMP_HEDER), nil)
-				}
+		if !handler.isIdempotentMethod(h.Method) {
+			next.ServeHTTP(rw, h)
+			return
+		}
+
+		key := h.Header.Get(handler.headerName)
+		if key == "" {
+			if handler.requireKey {
+				http.Error(rw, fmt.Sprintf("missing required %s header", handler.headerName), http.StatusBadRequest)
+				return
+			}
+			next.ServeHTTP(rw, h)
+			return
+		}
+		if err := handler.keyValidator(key); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		ctx := h.Context()
+		if handler.propagator != nil {
+			ctx = handler.propagator.Extract(ctx, propagation.HeaderCarrier(h.Header))
+		}
+		ctx, span := handler.tracer.Start(ctx, "IdempotencyHandler.MiddlewareIdempotency")
+		defer span.End()
+
+		body, err := io.ReadAll(h.Body)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			http.Error(rw, "failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		h.Body = io.NopCloser(bytes.NewReader(body))
+		bodyHash := hashRequest(h.Method, h.URL.Path, body)
+
+		lookupStart := time.Now()
+		cached, found, err := handler.repo.GetResponse(key, ctx)
+		handler.lookupLatency.Record(ctx, float64(time.Since(lookupStart).Milliseconds()))
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			http.Error(rw, "failed to look up cached response", http.StatusInternalServerError)
+			return
+		}
+		if found {
+			handler.replayOrConflict(ctx, span, rw, cached, bodyHash)
+			return
+		}
+		handler.missCounter.Add(ctx, 1)
+
+		acquired, err := handler.repo.AcquireLock(key, ctx)
+		if err != nil {
+			span.SetStatus(codes.Error, err.Error())
+			http.Error(rw, "failed to acquire idempotency lock", http.StatusInternalServerError)
+			return
+		}
+		if !acquired {
+			cached, found := handler.awaitResponse(key, ctx)
+			if !found {
+				http.Error(rw, "a request with this idempotency key is still in flight", http.StatusTooEarly)
+				return
+			}
+			handler.replayOrConflict(ctx, span, rw, cached, bodyHash)
+			return
+		}
+		defer handler.repo.ReleaseLock(key, ctx)
+
+		rec := newResponseRecorder(rw)
+		next.ServeHTTP(rec, h)
+		header := rec.Header().Clone()
+		rec.flush()
+
+		if rec.statusCode >= http.StatusOK && rec.statusCode < http.StatusMultipleChoices {
+			if err := handler.repo.SaveResponse(key, &CachedResponse{
+				StatusCode: rec.statusCode,
+				Header:     header,
+				Body:       rec.body.Bytes(),
+				BodyHash:   bodyHash,
+			}, handler.ttl, ctx); err != nil {
+				// The real response was already flushed to rw above, so a cache-write
+				// failure here can only be surfaced on the span, never to the client.
+				span.SetStatus(codes.Error, err.Error())
 			}
 		}
-		next.ServeHTTP(rw, h)
 	})
 }
+
+/*
+awaitResponse polls the repo for a cached response while another request with
+the same idempotency key is still in flight, so the waiting request can reuse
+its result instead of racing it.
+*/
+func (handler *IdempotencyHandlerImpl) awaitResponse(key string, ctx context.Context) (*CachedResponse, bool) {
+	deadline := time.Now().Add(lockWaitTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(lockPollInterval)
+		if cached, found, err := handler.repo.GetResponse(key, ctx); err == nil && found {
+			return cached, true
+		}
+	}
+	return nil, false
+}
+
+/*
+replayOrConflict compares cached.BodyHash against bodyHash: on a match it
+replays cached verbatim and counts a hit; on a mismatch it counts a conflict,
+marks span as errored, and writes 409 Conflict instead, per
+draft-ietf-httpapi-idempotency-key-header. Shared by the direct-hit path and
+the lock-wait path so the two can't drift apart.
+*/
+func (handler *IdempotencyHandlerImpl) replayOrConflict(ctx context.Context, span trace.Span, rw http.ResponseWriter, cached *CachedResponse, bodyHash string) {
+	if cached.BodyHash != bodyHash {
+		handler.conflictCounter.Add(ctx, 1)
+		span.SetStatus(codes.Error, "idempotency key reused with a different request body")
+		http.Error(rw, "a request with this idempotency key was already processed with a different request body", http.StatusConflict)
+		return
+	}
+	handler.hitCounter.Add(ctx, 1)
+	writeCachedResponse(rw, cached)
+}
+
+/*
+writeCachedResponse replays a previously stored response verbatim: headers
+first, then the status code, then the body.
+*/
+func writeCachedResponse(rw http.ResponseWriter, cached *CachedResponse) {
+	for key, values := range cached.Header {
+		for _, value := range values {
+			rw.Header().Add(key, value)
+		}
+	}
+	rw.WriteHeader(cached.StatusCode)
+	rw.Write(cached.Body)
+}
+
+/*
+hashRequest computes a stable hash over the method, path and body of a request
+so that two requests sharing an idempotency key can be checked for payload
+conflicts.
+*/
+func hashRequest(method, path string, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(method))
+	h.Write([]byte(path))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+/*
+isIdempotentMethod reports whether method is one of handler.methods, i.e. one
+that can mutate state and therefore needs idempotency-key handling.
+*/
+func (handler *IdempotencyHandlerImpl) isIdempotentMethod(method string) bool {
+	return handler.methods[method]
+}
+
+func tooManyArgumentsError(fnc string) error {
+	return fmt.Errorf("%s : you passed in to many argumants into this function", fnc)
+}
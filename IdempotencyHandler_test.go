@@ -0,0 +1,248 @@
+package idempLib
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+/*
+mockDriver is a Driver whose behavior is overridden per test via function
+fields; any field left nil falls back to a "nothing stored yet" response.
+*/
+type mockDriver struct {
+	getResponse  func(id string, ctx context.Context) (*CachedResponse, bool, error)
+	saveResponse func(id string, resp *CachedResponse, ttl time.Duration, ctx context.Context) error
+	acquireLock  func(id string, ctx context.Context) (bool, error)
+	releaseLock  func(id string, ctx context.Context) error
+}
+
+func (m *mockDriver) GetResponse(id string, ctx context.Context) (*CachedResponse, bool, error) {
+	if m.getResponse != nil {
+		return m.getResponse(id, ctx)
+	}
+	return nil, false, nil
+}
+
+func (m *mockDriver) SaveResponse(id string, resp *CachedResponse, ttl time.Duration, ctx context.Context) error {
+	if m.saveResponse != nil {
+		return m.saveResponse(id, resp, ttl, ctx)
+	}
+	return nil
+}
+
+func (m *mockDriver) AcquireLock(id string, ctx context.Context) (bool, error) {
+	if m.acquireLock != nil {
+		return m.acquireLock(id, ctx)
+	}
+	return true, nil
+}
+
+func (m *mockDriver) ReleaseLock(id string, ctx context.Context) error {
+	if m.releaseLock != nil {
+		return m.releaseLock(id, ctx)
+	}
+	return nil
+}
+
+func newTestHandler(t *testing.T, driver Driver) IdempotencyHandler {
+	t.Helper()
+	handler, err := NewIdempotencyHandler(driver)
+	if err != nil {
+		t.Fatalf("NewIdempotencyHandler: %v", err)
+	}
+	return handler
+}
+
+func doRequest(handler IdempotencyHandler, next http.Handler, key string) *httptest.ResponseRecorder {
+	mw := handler.MiddlewareIdempotency(next)
+	req := httptest.NewRequest(http.MethodPost, "/widgets", strings.NewReader(`{"a":1}`))
+	if key != "" {
+		req.Header.Set(DefaultIdempotencyKeyHeader, key)
+	}
+	rw := httptest.NewRecorder()
+	mw.ServeHTTP(rw, req)
+	return rw
+}
+
+type driverError struct{ msg string }
+
+func (e *driverError) Error() string { return e.msg }
+
+var errRedisDown = &driverError{"redis unavailable"}
+
+func TestMiddlewareAcquireLockErrorDoesNotRunHandlerOrReleaseLock(t *testing.T) {
+	nextCalled := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		nextCalled = true
+		rw.WriteHeader(http.StatusCreated)
+	})
+
+	releaseCalled := false
+	driver := &mockDriver{
+		acquireLock: func(id string, ctx context.Context) (bool, error) {
+			return false, errRedisDown
+		},
+		releaseLock: func(id string, ctx context.Context) error {
+			releaseCalled = true
+			return nil
+		},
+	}
+
+	rw := doRequest(newTestHandler(t, driver), next, "key-1")
+
+	if nextCalled {
+		t.Error("next handler ran despite AcquireLock failing")
+	}
+	if releaseCalled {
+		t.Error("ReleaseLock was called for a lock this request never acquired")
+	}
+	if rw.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusInternalServerError)
+	}
+}
+
+func TestMiddlewareReplaysResponseFoundWhileWaitingForLock(t *testing.T) {
+	cached := &CachedResponse{StatusCode: http.StatusCreated, Header: http.Header{}, Body: []byte("done"), BodyHash: hashRequest(http.MethodPost, "/widgets", []byte(`{"a":1}`))}
+
+	lookups := 0
+	driver := &mockDriver{
+		acquireLock: func(id string, ctx context.Context) (bool, error) {
+			return false, nil
+		},
+		getResponse: func(id string, ctx context.Context) (*CachedResponse, bool, error) {
+			lookups++
+			if lookups < 2 {
+				return nil, false, nil
+			}
+			return cached, true, nil
+		},
+	}
+
+	rw := doRequest(newTestHandler(t, driver), http.NotFoundHandler(), "key-2")
+
+	if rw.Code != http.StatusCreated {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusCreated)
+	}
+	if rw.Body.String() != "done" {
+		t.Errorf("body = %q, want %q", rw.Body.String(), "done")
+	}
+}
+
+func TestMiddlewareReturnsTooEarlyWhenLockNeverClears(t *testing.T) {
+	driver := &mockDriver{
+		acquireLock: func(id string, ctx context.Context) (bool, error) {
+			return false, nil
+		},
+	}
+
+	rw := doRequest(newTestHandler(t, driver), http.NotFoundHandler(), "key-3")
+
+	if rw.Code != http.StatusTooEarly {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusTooEarly)
+	}
+}
+
+func TestMiddlewareReturnsConflictOnBodyHashMismatch(t *testing.T) {
+	driver := &mockDriver{
+		getResponse: func(id string, ctx context.Context) (*CachedResponse, bool, error) {
+			return &CachedResponse{StatusCode: http.StatusOK, BodyHash: "some-other-body"}, true, nil
+		},
+	}
+
+	nextCalled := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { nextCalled = true })
+
+	rw := doRequest(newTestHandler(t, driver), next, "key-4")
+
+	if nextCalled {
+		t.Error("next handler ran for a conflicting idempotency key reuse")
+	}
+	if rw.Code != http.StatusConflict {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusConflict)
+	}
+}
+
+func TestMiddlewareRequireKeyRejectsRequestWithNoHeader(t *testing.T) {
+	handler, err := NewIdempotencyHandler(&mockDriver{}, WithRequireKey())
+	if err != nil {
+		t.Fatalf("NewIdempotencyHandler: %v", err)
+	}
+
+	nextCalled := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { nextCalled = true })
+
+	rw := doRequest(handler, next, "")
+
+	if nextCalled {
+		t.Error("next handler ran despite the idempotency key header being required and absent")
+	}
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMiddlewareRejectsMalformedKey(t *testing.T) {
+	handler, err := NewIdempotencyHandler(&mockDriver{}, WithKeyValidator(UUIDKeyValidator))
+	if err != nil {
+		t.Fatalf("NewIdempotencyHandler: %v", err)
+	}
+
+	nextCalled := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { nextCalled = true })
+
+	rw := doRequest(handler, next, "not-a-uuid")
+
+	if nextCalled {
+		t.Error("next handler ran despite the idempotency key failing validation")
+	}
+	if rw.Code != http.StatusBadRequest {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusBadRequest)
+	}
+}
+
+func TestMiddlewareSaveResponseFailureDoesNotCorruptClientResponse(t *testing.T) {
+	driver := &mockDriver{
+		saveResponse: func(id string, resp *CachedResponse, ttl time.Duration, ctx context.Context) error {
+			return errRedisDown
+		},
+	}
+
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusCreated)
+		rw.Write([]byte(`{"ok":true}`))
+	})
+
+	rw := doRequest(newTestHandler(t, driver), next, "key-6")
+
+	if rw.Code != http.StatusCreated {
+		t.Errorf("status = %d, want %d", rw.Code, http.StatusCreated)
+	}
+	if rw.Body.String() != `{"ok":true}` {
+		t.Errorf("body = %q, want %q (a cache-write failure must not be appended to the client response)", rw.Body.String(), `{"ok":true}`)
+	}
+}
+
+func TestMiddlewareReplaysMatchingCachedResponse(t *testing.T) {
+	bodyHash := hashRequest(http.MethodPost, "/widgets", []byte(`{"a":1}`))
+	driver := &mockDriver{
+		getResponse: func(id string, ctx context.Context) (*CachedResponse, bool, error) {
+			return &CachedResponse{StatusCode: http.StatusCreated, Header: http.Header{}, Body: []byte("cached"), BodyHash: bodyHash}, true, nil
+		},
+	}
+
+	nextCalled := false
+	next := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) { nextCalled = true })
+
+	rw := doRequest(newTestHandler(t, driver), next, "key-5")
+
+	if nextCalled {
+		t.Error("next handler ran despite a matching cached response")
+	}
+	if rw.Code != http.StatusCreated || rw.Body.String() != "cached" {
+		t.Errorf("got status=%d body=%q, want status=%d body=%q", rw.Code, rw.Body.String(), http.StatusCreated, "cached")
+	}
+}
@@ -0,0 +1,36 @@
+package idempLib
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+/*
+CachedResponse holds everything we need to replay a previously handled request
+verbatim: the status code, the response headers and the raw body, plus the
+bodyHash of the request that produced it so future callers can be checked for
+a conflicting payload under the same idempotency key.
+*/
+type CachedResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+	BodyHash   string
+}
+
+/*
+Driver is the pluggable storage backend behind the idempotency handler: it
+caches responses and arbitrates the per-key lock that coalesces concurrent
+requests. Redis (NewIdempotenceRepo) remains the default, with NewMemoryDriver
+and NewEtcdDriver available for local development/tests and for clusters that
+already run etcd or an embedded distributed SQLite (dqlite) instead of redis.
+NewIdempotencyHandler takes a Driver by interface so callers can inject their
+own implementation, including mocks, in tests.
+*/
+type Driver interface {
+	GetResponse(id string, ctx context.Context) (*CachedResponse, bool, error)
+	SaveResponse(id string, resp *CachedResponse, ttl time.Duration, ctx context.Context) error
+	AcquireLock(id string, ctx context.Context) (bool, error)
+	ReleaseLock(id string, ctx context.Context) error
+}
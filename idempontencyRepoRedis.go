@@ -2,54 +2,116 @@ package idempLib
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/go-redis/redis"
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/codes"
 	"go.opentelemetry.io/otel/trace"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
 type idempontencyRepoRedis struct {
-	cli    *redis.Client
+	cli    redis.UniversalClient
 	Tracer trace.Tracer
 }
 
-type IdempontencyRepo interface {
-	Exists(id string, ctx context.Context) bool
-	Save(id string, ctx context.Context) (string, error)
-}
-
 const (
-	reqKey = "req:%s"
+	reqKey  = "req:%s"
+	lockKey = "lock:%s"
+
+	lockTTL = 10 * time.Second
 )
 
 /*
-NewIdempotenceRepo generates new instance of idempontency repo and takes in tracer as optional parameter.
-Function also returns tooManyArgumentsErr if we pass in more than one tracer as a parameter.
-Error is thrown if IDEMPOTENCE_REDIS_HOST or IDEMPOTENCE_REDIS_PORT variables are not find in .env
+RedisConfig describes how to reach the redis deployment backing the idempotency
+store. Setting MasterName selects a Sentinel-backed NewFailoverClient, more
+than one address with no MasterName selects a NewClusterClient, and a single
+address with neither set falls back to a plain standalone client.
 */
-func NewIdempotenceRepo(tracer ...trace.Tracer) (IdempontencyRepo, error) {
+type RedisConfig struct {
+	Addrs      []string
+	MasterName string
+	Username   string
+	Password   string
+	DB         int
+	TLSConfig  *tls.Config
+}
 
-	if len(tracer) > 1 {
-		return nil, tooManyArgumentsError("NewIdempotenceRepo")
+/*
+RedisConfigFromEnv builds a RedisConfig from the IDEMPOTENCE_REDIS_* environment
+variables. IDEMPOTENCE_REDIS_HOST and IDEMPOTENCE_REDIS_PORT remain the minimum
+required pair for a standalone deployment. IDEMPOTENCE_REDIS_SENTINEL_ADDRS (comma
+separated, paired with IDEMPOTENCE_REDIS_MASTER_NAME) or IDEMPOTENCE_REDIS_CLUSTER_ADDRS
+(comma separated) opt into HA modes instead. IDEMPOTENCE_REDIS_USERNAME,
+IDEMPOTENCE_REDIS_PASSWORD, IDEMPOTENCE_REDIS_DB and IDEMPOTENCE_REDIS_TLS are optional
+on top of any of the above.
+*/
+func RedisConfigFromEnv() (RedisConfig, error) {
+	var cfg RedisConfig
+
+	if sentinelAddrs := os.Getenv("IDEMPOTENCE_REDIS_SENTINEL_ADDRS"); sentinelAddrs != "" {
+		cfg.Addrs = strings.Split(sentinelAddrs, ",")
+		cfg.MasterName = os.Getenv("IDEMPOTENCE_REDIS_MASTER_NAME")
+	} else if clusterAddrs := os.Getenv("IDEMPOTENCE_REDIS_CLUSTER_ADDRS"); clusterAddrs != "" {
+		cfg.Addrs = strings.Split(clusterAddrs, ",")
+	} else {
+		host := os.Getenv("IDEMPOTENCE_REDIS_HOST")
+		port := os.Getenv("IDEMPOTENCE_REDIS_PORT")
+
+		if host == "" || port == "" {
+			return RedisConfig{}, errors.New("couldn't read .env variables for IDEMPOTENCE_REDIS_HOST,IDEMPOTENCE_REDIS_PORT. Please check if you provided them correctly")
+		}
+		cfg.Addrs = []string{fmt.Sprintf("%s:%s", host, port)}
 	}
 
-	if len(tracer) == 0 {
-		tracer = make([]trace.Tracer, 1)
+	cfg.Username = os.Getenv("IDEMPOTENCE_REDIS_USERNAME")
+	cfg.Password = os.Getenv("IDEMPOTENCE_REDIS_PASSWORD")
+
+	if db := os.Getenv("IDEMPOTENCE_REDIS_DB"); db != "" {
+		parsed, err := strconv.Atoi(db)
+		if err != nil {
+			return RedisConfig{}, fmt.Errorf("invalid IDEMPOTENCE_REDIS_DB %q: %w", db, err)
+		}
+		cfg.DB = parsed
+	}
+
+	if os.Getenv("IDEMPOTENCE_REDIS_TLS") == "true" {
+		cfg.TLSConfig = &tls.Config{}
 	}
 
-	host := os.Getenv("IDEMPOTENCE_REDIS_HOST")
-	port := os.Getenv("IDEMPOTENCE_REDIS_PORT")
+	return cfg, nil
+}
+
+/*
+NewIdempotenceRepo generates new instance of idempontency repo for the given
+RedisConfig and takes in tracer as optional parameter. When no tracer is
+passed, one is pulled from otel.GetTracerProvider() so callers and this repo
+never have to nil-check it. Function also returns a tooManyArgumentsError if we
+pass in more than one tracer as a parameter.
+*/
+func NewIdempotenceRepo(cfg RedisConfig, tracer ...trace.Tracer) (Driver, error) {
 
-	if host == "" || port == "" {
-		return nil, errors.New("couldn't read .env variables for IDEMPOTENCE_REDIS_HOST,IDEMPOTENCE_REDIS_PORT. Please check if you provided them correctly")
+	if len(tracer) > 1 {
+		return nil, tooManyArgumentsError("NewIdempotenceRepo")
+	}
+
+	if len(tracer) == 0 {
+		tracer = []trace.Tracer{otel.Tracer(instrumentationName)}
 	}
-	adr := fmt.Sprintf("%s:%s", host, port)
 
-	client := redis.NewClient(&redis.Options{
-		Addr: adr,
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:      cfg.Addrs,
+		MasterName: cfg.MasterName,
+		Username:   cfg.Username,
+		Password:   cfg.Password,
+		DB:         cfg.DB,
+		TLSConfig:  cfg.TLSConfig,
 	})
 
 	return idempontencyRepoRedis{
@@ -59,39 +121,84 @@ func NewIdempotenceRepo(tracer ...trace.Tracer) (IdempontencyRepo, error) {
 }
 
 /*
-Exists checks if provided id exists in db and returns bool as response
+GetResponse looks up the cached response stored for the given idempotency key.
+The second return value reports whether a response was found at all.
 */
-func (i idempontencyRepoRedis) Exists(id string, ctx context.Context) bool {
-	if i.Tracer != nil {
-		_, span := i.Tracer.Start(ctx, "IdempontencyRepoRedis.Exists")
-		defer span.End()
+func (i idempontencyRepoRedis) GetResponse(id string, ctx context.Context) (*CachedResponse, bool, error) {
+	_, span := i.Tracer.Start(ctx, "IdempontencyRepoRedis.GetResponse")
+	defer span.End()
+
+	raw, err := i.cli.Get(ctx, constructKey(id)).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, false, err
+	}
+
+	var cached CachedResponse
+	if err := json.Unmarshal(raw, &cached); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return nil, false, err
 	}
 
-	return i.cli.Exists(constructKey(id)).Val() == 1
+	return &cached, true, nil
 }
 
 /*
-Save stores provided id in db with TTL : 3min
+SaveResponse stores the response produced for id so that replayed requests with
+the same idempotency key can be served verbatim. The entry expires after ttl.
 */
-func (i idempontencyRepoRedis) Save(id string, ctx context.Context) (string, error) {
+func (i idempontencyRepoRedis) SaveResponse(id string, resp *CachedResponse, ttl time.Duration, ctx context.Context) error {
 	key := constructKey(id)
 
-	if i.Tracer != nil {
-		_, span := i.Tracer.Start(ctx, "IdempontencyRepoRedis.Save")
-		defer span.End()
+	_, span := i.Tracer.Start(ctx, "IdempontencyRepoRedis.SaveResponse")
+	defer span.End()
 
-		err := i.cli.Set(key, true, time.Duration(3)*time.Minute).Err()
-		if err != nil {
-			span.SetStatus(codes.Error, err.Error())
-			return "", err
-		}
-	} else {
-		err := i.cli.Set(key, true, time.Duration(3)*time.Minute).Err()
-		if err != nil {
-			return "", err
-		}
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+
+	if err := i.cli.Set(ctx, key, raw, ttl).Err(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
 	}
-	return id, nil
+
+	return nil
+}
+
+/*
+AcquireLock takes out a short-lived lease (SET NX PX semantics) for id so that
+only one in-flight request at a time actually runs the handler for a given
+idempotency key. The returned bool reports whether the lease was acquired.
+*/
+func (i idempontencyRepoRedis) AcquireLock(id string, ctx context.Context) (bool, error) {
+	_, span := i.Tracer.Start(ctx, "IdempontencyRepoRedis.AcquireLock")
+	defer span.End()
+
+	acquired, err := i.cli.SetNX(ctx, constructLockKey(id), 1, lockTTL).Result()
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return acquired, err
+}
+
+/*
+ReleaseLock releases the lease acquired by AcquireLock, so the next distinct
+request can proceed immediately instead of waiting out lockTTL.
+*/
+func (i idempontencyRepoRedis) ReleaseLock(id string, ctx context.Context) error {
+	_, span := i.Tracer.Start(ctx, "IdempontencyRepoRedis.ReleaseLock")
+	defer span.End()
+
+	if err := i.cli.Del(ctx, constructLockKey(id)).Err(); err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return err
+	}
+	return nil
 }
 
 /*
@@ -100,3 +207,10 @@ constructKey constructs our db key based on UUID(as a string) that is passed in
 func constructKey(id string) string {
 	return fmt.Sprintf(reqKey, id)
 }
+
+/*
+constructLockKey constructs the key under which the in-flight lease for id is held.
+*/
+func constructLockKey(id string) string {
+	return fmt.Sprintf(lockKey, id)
+}
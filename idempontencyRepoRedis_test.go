@@ -0,0 +1,114 @@
+package idempLib
+
+import "testing"
+
+func clearRedisEnv(t *testing.T) {
+	t.Helper()
+	for _, name := range []string{
+		"IDEMPOTENCE_REDIS_SENTINEL_ADDRS",
+		"IDEMPOTENCE_REDIS_MASTER_NAME",
+		"IDEMPOTENCE_REDIS_CLUSTER_ADDRS",
+		"IDEMPOTENCE_REDIS_HOST",
+		"IDEMPOTENCE_REDIS_PORT",
+		"IDEMPOTENCE_REDIS_USERNAME",
+		"IDEMPOTENCE_REDIS_PASSWORD",
+		"IDEMPOTENCE_REDIS_DB",
+		"IDEMPOTENCE_REDIS_TLS",
+	} {
+		t.Setenv(name, "")
+	}
+}
+
+func TestRedisConfigFromEnvStandalone(t *testing.T) {
+	clearRedisEnv(t)
+	t.Setenv("IDEMPOTENCE_REDIS_HOST", "localhost")
+	t.Setenv("IDEMPOTENCE_REDIS_PORT", "6379")
+
+	cfg, err := RedisConfigFromEnv()
+	if err != nil {
+		t.Fatalf("RedisConfigFromEnv: %v", err)
+	}
+	if len(cfg.Addrs) != 1 || cfg.Addrs[0] != "localhost:6379" {
+		t.Errorf("Addrs = %v, want [localhost:6379]", cfg.Addrs)
+	}
+	if cfg.MasterName != "" {
+		t.Errorf("MasterName = %q, want empty for standalone mode", cfg.MasterName)
+	}
+}
+
+func TestRedisConfigFromEnvStandaloneRequiresHostAndPort(t *testing.T) {
+	clearRedisEnv(t)
+	t.Setenv("IDEMPOTENCE_REDIS_HOST", "localhost")
+
+	if _, err := RedisConfigFromEnv(); err == nil {
+		t.Error("RedisConfigFromEnv accepted a host with no port and no HA mode selected")
+	}
+}
+
+func TestRedisConfigFromEnvSentinel(t *testing.T) {
+	clearRedisEnv(t)
+	t.Setenv("IDEMPOTENCE_REDIS_SENTINEL_ADDRS", "10.0.0.1:26379,10.0.0.2:26379")
+	t.Setenv("IDEMPOTENCE_REDIS_MASTER_NAME", "mymaster")
+
+	cfg, err := RedisConfigFromEnv()
+	if err != nil {
+		t.Fatalf("RedisConfigFromEnv: %v", err)
+	}
+	if len(cfg.Addrs) != 2 || cfg.Addrs[0] != "10.0.0.1:26379" || cfg.Addrs[1] != "10.0.0.2:26379" {
+		t.Errorf("Addrs = %v, want [10.0.0.1:26379 10.0.0.2:26379]", cfg.Addrs)
+	}
+	if cfg.MasterName != "mymaster" {
+		t.Errorf("MasterName = %q, want %q", cfg.MasterName, "mymaster")
+	}
+}
+
+func TestRedisConfigFromEnvCluster(t *testing.T) {
+	clearRedisEnv(t)
+	t.Setenv("IDEMPOTENCE_REDIS_CLUSTER_ADDRS", "10.0.0.1:6379,10.0.0.2:6379,10.0.0.3:6379")
+
+	cfg, err := RedisConfigFromEnv()
+	if err != nil {
+		t.Fatalf("RedisConfigFromEnv: %v", err)
+	}
+	if len(cfg.Addrs) != 3 {
+		t.Errorf("Addrs = %v, want 3 addresses", cfg.Addrs)
+	}
+	if cfg.MasterName != "" {
+		t.Errorf("MasterName = %q, want empty for cluster mode", cfg.MasterName)
+	}
+}
+
+func TestRedisConfigFromEnvOptionalFields(t *testing.T) {
+	clearRedisEnv(t)
+	t.Setenv("IDEMPOTENCE_REDIS_HOST", "localhost")
+	t.Setenv("IDEMPOTENCE_REDIS_PORT", "6379")
+	t.Setenv("IDEMPOTENCE_REDIS_USERNAME", "alice")
+	t.Setenv("IDEMPOTENCE_REDIS_PASSWORD", "hunter2")
+	t.Setenv("IDEMPOTENCE_REDIS_DB", "3")
+	t.Setenv("IDEMPOTENCE_REDIS_TLS", "true")
+
+	cfg, err := RedisConfigFromEnv()
+	if err != nil {
+		t.Fatalf("RedisConfigFromEnv: %v", err)
+	}
+	if cfg.Username != "alice" || cfg.Password != "hunter2" {
+		t.Errorf("Username/Password = %q/%q, want alice/hunter2", cfg.Username, cfg.Password)
+	}
+	if cfg.DB != 3 {
+		t.Errorf("DB = %d, want 3", cfg.DB)
+	}
+	if cfg.TLSConfig == nil {
+		t.Error("TLSConfig = nil, want non-nil since IDEMPOTENCE_REDIS_TLS=true")
+	}
+}
+
+func TestRedisConfigFromEnvInvalidDB(t *testing.T) {
+	clearRedisEnv(t)
+	t.Setenv("IDEMPOTENCE_REDIS_HOST", "localhost")
+	t.Setenv("IDEMPOTENCE_REDIS_PORT", "6379")
+	t.Setenv("IDEMPOTENCE_REDIS_DB", "not-a-number")
+
+	if _, err := RedisConfigFromEnv(); err == nil {
+		t.Error("RedisConfigFromEnv accepted a non-numeric IDEMPOTENCE_REDIS_DB")
+	}
+}
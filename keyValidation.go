@@ -0,0 +1,65 @@
+package idempLib
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	minKeyLength = 1
+	maxKeyLength = 255
+)
+
+/*
+KeyValidator checks an idempotency key before it is looked up or stored.
+Returning a non-nil error rejects the request with 400 Bad Request. Pass one
+to NewIdempotencyHandler via WithKeyValidator to enforce a stricter format
+than DefaultKeyValidator.
+*/
+type KeyValidator func(key string) error
+
+/*
+DefaultKeyValidator only enforces the length bounds recommended by
+draft-ietf-httpapi-idempotency-key-header: a non-empty key up to
+maxKeyLength characters. It does not constrain the key's format.
+*/
+func DefaultKeyValidator(key string) error {
+	if len(key) < minKeyLength || len(key) > maxKeyLength {
+		return fmt.Errorf("idempotency key must be between %d and %d characters, got %d", minKeyLength, maxKeyLength, len(key))
+	}
+	return nil
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+/*
+UUIDKeyValidator additionally requires the key to be a canonical 8-4-4-4-12
+hex UUID, for deployments that mint idempotency keys with uuid.NewString()
+or similar.
+*/
+func UUIDKeyValidator(key string) error {
+	if err := DefaultKeyValidator(key); err != nil {
+		return err
+	}
+	if !uuidPattern.MatchString(key) {
+		return fmt.Errorf("idempotency key %q is not a valid UUID", key)
+	}
+	return nil
+}
+
+var ulidPattern = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Za-hjkmnp-tv-z]{25}$`)
+
+/*
+ULIDKeyValidator additionally requires the key to be a 26-character Crockford
+base32 ULID, for deployments that mint idempotency keys with a ULID generator
+instead of a UUID one.
+*/
+func ULIDKeyValidator(key string) error {
+	if err := DefaultKeyValidator(key); err != nil {
+		return err
+	}
+	if !ulidPattern.MatchString(key) {
+		return fmt.Errorf("idempotency key %q is not a valid ULID", key)
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+package idempLib
+
+import "testing"
+
+func TestDefaultKeyValidatorRejectsEmptyKey(t *testing.T) {
+	if err := DefaultKeyValidator(""); err == nil {
+		t.Error("DefaultKeyValidator accepted an empty key")
+	}
+}
+
+func TestDefaultKeyValidatorRejectsTooLongKey(t *testing.T) {
+	key := make([]byte, maxKeyLength+1)
+	for i := range key {
+		key[i] = 'a'
+	}
+	if err := DefaultKeyValidator(string(key)); err == nil {
+		t.Error("DefaultKeyValidator accepted a key longer than maxKeyLength")
+	}
+}
+
+func TestDefaultKeyValidatorAcceptsKeyWithinBounds(t *testing.T) {
+	if err := DefaultKeyValidator("a-reasonable-key"); err != nil {
+		t.Errorf("DefaultKeyValidator rejected a valid key: %v", err)
+	}
+}
+
+func TestUUIDKeyValidator(t *testing.T) {
+	if err := UUIDKeyValidator("2f3e4a9c-5b1d-4e7a-9c2f-6d8b1a0e3c7f"); err != nil {
+		t.Errorf("UUIDKeyValidator rejected a valid UUID: %v", err)
+	}
+	if err := UUIDKeyValidator("not-a-uuid"); err == nil {
+		t.Error("UUIDKeyValidator accepted a non-UUID key")
+	}
+}
+
+func TestULIDKeyValidator(t *testing.T) {
+	if err := ULIDKeyValidator("01ARZ3NDEKTSV4RRFFQ69G5FAV"); err != nil {
+		t.Errorf("ULIDKeyValidator rejected a valid ULID: %v", err)
+	}
+	if err := ULIDKeyValidator("not-a-ulid"); err == nil {
+		t.Error("ULIDKeyValidator accepted a non-ULID key")
+	}
+}
@@ -0,0 +1,101 @@
+package idempLib
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const janitorInterval = time.Minute
+
+type memoryEntry struct {
+	response  *CachedResponse
+	expiresAt time.Time
+}
+
+type memoryDriver struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+	locks   map[string]time.Time
+}
+
+/*
+NewMemoryDriver creates an in-process Driver backed by a TTL map, for local
+development and tests where standing up redis (or etcd) is unnecessary. A
+janitor goroutine sweeps expired entries and locks every janitorInterval so
+the maps don't grow unbounded.
+*/
+func NewMemoryDriver() Driver {
+	d := &memoryDriver{
+		entries: make(map[string]memoryEntry),
+		locks:   make(map[string]time.Time),
+	}
+	go d.janitor()
+	return d
+}
+
+func (d *memoryDriver) janitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		d.sweep()
+	}
+}
+
+func (d *memoryDriver) sweep() {
+	now := time.Now()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, entry := range d.entries {
+		if now.After(entry.expiresAt) {
+			delete(d.entries, key)
+		}
+	}
+	for key, expiresAt := range d.locks {
+		if now.After(expiresAt) {
+			delete(d.locks, key)
+		}
+	}
+}
+
+func (d *memoryDriver) GetResponse(id string, ctx context.Context) (*CachedResponse, bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	entry, ok := d.entries[id]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return nil, false, nil
+	}
+
+	return entry.response, true, nil
+}
+
+func (d *memoryDriver) SaveResponse(id string, resp *CachedResponse, ttl time.Duration, ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.entries[id] = memoryEntry{response: resp, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+func (d *memoryDriver) AcquireLock(id string, ctx context.Context) (bool, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if expiresAt, ok := d.locks[id]; ok && time.Now().Before(expiresAt) {
+		return false, nil
+	}
+
+	d.locks[id] = time.Now().Add(lockTTL)
+	return true, nil
+}
+
+func (d *memoryDriver) ReleaseLock(id string, ctx context.Context) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.locks, id)
+	return nil
+}
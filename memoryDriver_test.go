@@ -0,0 +1,92 @@
+package idempLib
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestMemoryDriverSaveAndGetResponse(t *testing.T) {
+	d := &memoryDriver{entries: make(map[string]memoryEntry), locks: make(map[string]time.Time)}
+	ctx := context.Background()
+
+	if _, found, err := d.GetResponse("key", ctx); err != nil || found {
+		t.Fatalf("GetResponse on empty store: got found=%v err=%v, want found=false err=nil", found, err)
+	}
+
+	want := &CachedResponse{StatusCode: 201, BodyHash: "abc"}
+	if err := d.SaveResponse("key", want, time.Minute, ctx); err != nil {
+		t.Fatalf("SaveResponse: %v", err)
+	}
+
+	got, found, err := d.GetResponse("key", ctx)
+	if err != nil || !found {
+		t.Fatalf("GetResponse after save: got found=%v err=%v, want found=true err=nil", found, err)
+	}
+	if got.StatusCode != want.StatusCode || got.BodyHash != want.BodyHash {
+		t.Fatalf("GetResponse returned %+v, want %+v", got, want)
+	}
+}
+
+func TestMemoryDriverResponseExpires(t *testing.T) {
+	d := &memoryDriver{entries: make(map[string]memoryEntry), locks: make(map[string]time.Time)}
+	ctx := context.Background()
+
+	if err := d.SaveResponse("key", &CachedResponse{StatusCode: 200}, 10*time.Millisecond, ctx); err != nil {
+		t.Fatalf("SaveResponse: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	if _, found, err := d.GetResponse("key", ctx); err != nil || found {
+		t.Fatalf("GetResponse after ttl: got found=%v err=%v, want found=false err=nil", found, err)
+	}
+}
+
+func TestMemoryDriverAcquireReleaseLock(t *testing.T) {
+	d := &memoryDriver{entries: make(map[string]memoryEntry), locks: make(map[string]time.Time)}
+	ctx := context.Background()
+
+	acquired, err := d.AcquireLock("key", ctx)
+	if err != nil || !acquired {
+		t.Fatalf("first AcquireLock: got acquired=%v err=%v, want acquired=true err=nil", acquired, err)
+	}
+
+	if acquired, err := d.AcquireLock("key", ctx); err != nil || acquired {
+		t.Fatalf("AcquireLock while held: got acquired=%v err=%v, want acquired=false err=nil", acquired, err)
+	}
+
+	if err := d.ReleaseLock("key", ctx); err != nil {
+		t.Fatalf("ReleaseLock: %v", err)
+	}
+
+	if acquired, err := d.AcquireLock("key", ctx); err != nil || !acquired {
+		t.Fatalf("AcquireLock after release: got acquired=%v err=%v, want acquired=true err=nil", acquired, err)
+	}
+}
+
+func TestMemoryDriverSweepRemovesExpiredEntriesAndLocks(t *testing.T) {
+	d := &memoryDriver{entries: make(map[string]memoryEntry), locks: make(map[string]time.Time)}
+
+	past := time.Now().Add(-time.Minute)
+	future := time.Now().Add(time.Minute)
+
+	d.entries["expired"] = memoryEntry{response: &CachedResponse{}, expiresAt: past}
+	d.entries["fresh"] = memoryEntry{response: &CachedResponse{}, expiresAt: future}
+	d.locks["expired"] = past
+	d.locks["fresh"] = future
+
+	d.sweep()
+
+	if _, ok := d.entries["expired"]; ok {
+		t.Error("sweep left an expired entry in place")
+	}
+	if _, ok := d.entries["fresh"]; !ok {
+		t.Error("sweep removed a non-expired entry")
+	}
+	if _, ok := d.locks["expired"]; ok {
+		t.Error("sweep left an expired lock in place")
+	}
+	if _, ok := d.locks["fresh"]; !ok {
+		t.Error("sweep removed a non-expired lock")
+	}
+}